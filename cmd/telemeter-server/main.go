@@ -7,6 +7,7 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
@@ -17,7 +18,9 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	oidc "github.com/coreos/go-oidc"
@@ -44,6 +47,7 @@ import (
 	"github.com/openshift/telemeter/pkg/store"
 	"github.com/openshift/telemeter/pkg/store/forward"
 	"github.com/openshift/telemeter/pkg/store/ratelimited"
+	"github.com/openshift/telemeter/pkg/tlsconfig"
 	"github.com/openshift/telemeter/pkg/validate"
 )
 
@@ -85,6 +89,14 @@ func main() {
 		Ratelimit:          4*time.Minute + 30*time.Second,
 		MemcachedExpire:    24 * 60 * 60,
 		MemcachedInterval:  10,
+
+		ForwardRetryCount:      receive.DefaultRetryConfig.MaxRetries,
+		ForwardRetryBackoff:    receive.DefaultRetryConfig.InitialBackoff,
+		ForwardRetryMaxBackoff: receive.DefaultRetryConfig.MaxBackoff,
+
+		ForwardQueueSize:            1000,
+		ForwardWorkers:              8,
+		ForwardMaxInflightPerTenant: 4,
 	}
 	cmd := &cobra.Command{
 		Short:         "Aggregate federated metrics pushes",
@@ -105,6 +117,9 @@ func main() {
 	cmd.Flags().StringVar(&opt.InternalTLSKeyPath, "internal-tls-key", opt.InternalTLSKeyPath, "Path to a private key to serve TLS for internal traffic.")
 	cmd.Flags().StringVar(&opt.InternalTLSCertificatePath, "internal-tls-crt", opt.InternalTLSCertificatePath, "Path to a certificate to serve TLS for internal traffic.")
 
+	cmd.Flags().StringVar(&opt.ClientCAFile, "client-ca-file", opt.ClientCAFile, "Path to a client CA bundle to require and verify client certificates against on /metrics/v1/receive. Both certificate and bundle are hot-reloaded on change. Requires --listen-receive-mtls, since /metrics/v1/receive is served from that listener instead of --listen so the client certificate requirement doesn't apply to /, /authorize and /upload.")
+	cmd.Flags().StringVar(&opt.ListenReceiveMTLS, "listen-receive-mtls", opt.ListenReceiveMTLS, "A host:port to serve /metrics/v1/receive on when --client-ca-file is set. Ignored otherwise.")
+
 	cmd.Flags().StringSliceVar(&opt.LabelFlag, "label", opt.LabelFlag, "Labels to add to each outgoing metric, in key=value form.")
 	cmd.Flags().StringVar(&opt.PartitionKey, "partition-label", opt.PartitionKey, "The label to separate incoming data on. This label will be required for callers to include.")
 
@@ -123,6 +138,16 @@ func main() {
 
 	cmd.Flags().DurationVar(&opt.Ratelimit, "ratelimit", opt.Ratelimit, "The rate limit of metric uploads per cluster ID. Uploads happening more often than this limit will be rejected.")
 	cmd.Flags().StringVar(&opt.ForwardURL, "forward-url", opt.ForwardURL, "All written metrics will be written to this URL additionally")
+	cmd.Flags().IntVar(&opt.ForwardRetryCount, "forward-retry-count", opt.ForwardRetryCount, "The number of times to retry a forwarded remote-write request on network errors or 429/5xx responses.")
+	cmd.Flags().DurationVar(&opt.ForwardRetryBackoff, "forward-retry-backoff", opt.ForwardRetryBackoff, "The initial backoff before retrying a failed forward; doubles (with jitter) on each subsequent retry.")
+	cmd.Flags().DurationVar(&opt.ForwardRetryMaxBackoff, "forward-retry-max-backoff", opt.ForwardRetryMaxBackoff, "The maximum backoff between retries of a failed forward.")
+	cmd.Flags().IntVar(&opt.ForwardQueueSize, "forward-queue-size", opt.ForwardQueueSize, "The total capacity of the forward queue, split evenly across the --forward-workers shards; a request is rejected once its tenant's shard is 90% full.")
+	cmd.Flags().IntVar(&opt.ForwardWorkers, "forward-workers", opt.ForwardWorkers, "The number of dispatcher goroutines forwarding queued requests to Thanos concurrently. Requests are sharded by tenant across these goroutines, so forwards for a given THANOS-TENANT are always dispatched in the order they were received.")
+	cmd.Flags().IntVar(&opt.ForwardMaxInflightPerTenant, "forward-max-inflight-per-tenant", opt.ForwardMaxInflightPerTenant, "The maximum number of forward requests a single tenant may have queued or in-flight at once; 0 means unlimited.")
+
+	cmd.Flags().DurationVar(&opt.ReceiveRatelimit, "receive-ratelimit", opt.ReceiveRatelimit, "The minimum interval between requests from a single tenant on /metrics/v1/receive; requests sent sooner are rejected. 0 disables rate limiting.")
+	cmd.Flags().IntVar(&opt.ReceiveMaxSeries, "receive-max-series", opt.ReceiveMaxSeries, "The maximum number of time series allowed in a single /metrics/v1/receive request. 0 disables the check.")
+	cmd.Flags().IntVar(&opt.ReceiveMaxSamples, "receive-max-samples", opt.ReceiveMaxSamples, "The maximum number of samples allowed in a single /metrics/v1/receive request. 0 disables the check.")
 
 	cmd.Flags().BoolVarP(&opt.Verbose, "verbose", "v", opt.Verbose, "Show verbose output.")
 
@@ -162,6 +187,9 @@ type Options struct {
 	InternalTLSKeyPath         string
 	InternalTLSCertificatePath string
 
+	ClientCAFile      string
+	ListenReceiveMTLS string
+
 	SharedKey          string
 	TokenExpireSeconds int64
 
@@ -188,6 +216,18 @@ type Options struct {
 	Ratelimit  time.Duration
 	ForwardURL string
 
+	ForwardRetryCount      int
+	ForwardRetryBackoff    time.Duration
+	ForwardRetryMaxBackoff time.Duration
+
+	ForwardQueueSize            int
+	ForwardWorkers              int
+	ForwardMaxInflightPerTenant int
+
+	ReceiveRatelimit  time.Duration
+	ReceiveMaxSeries  int
+	ReceiveMaxSamples int
+
 	LogLevel string
 	Logger   log.Logger
 
@@ -282,6 +322,16 @@ func (o *Options) Run() error {
 	useTLS := len(o.TLSCertificatePath) > 0
 	useInternalTLS := len(o.InternalTLSCertificatePath) > 0
 
+	useReceiveMTLS := len(o.ClientCAFile) > 0
+	if useReceiveMTLS {
+		if len(o.ListenReceiveMTLS) == 0 {
+			return fmt.Errorf("--listen-receive-mtls must be provided when --client-ca-file is set")
+		}
+		if !useTLS {
+			return fmt.Errorf("--tls-key and --tls-crt must be provided when --client-ca-file is set")
+		}
+	}
+
 	var (
 		publicKey  crypto.PublicKey
 		privateKey crypto.PrivateKey
@@ -379,10 +429,19 @@ func (o *Options) Run() error {
 	transforms.With(metricfamily.NewElide(o.ElideLabels...))
 
 	server := httpserver.New(o.Logger, store, validator, transforms)
-	receiver := receive.NewHandler(o.Logger, o.ForwardURL, prometheus.DefaultRegisterer)
+	receiver := receive.NewHandler(o.Logger, o.ForwardURL, prometheus.DefaultRegisterer, receive.RetryConfig{
+		MaxRetries:     o.ForwardRetryCount,
+		InitialBackoff: o.ForwardRetryBackoff,
+		MaxBackoff:     o.ForwardRetryMaxBackoff,
+	}, o.ForwardQueueSize, o.ForwardWorkers, o.ForwardMaxInflightPerTenant)
+
+	externalPaths := []string{"/", "/authorize", "/upload", "/healthz", "/healthz/ready"}
+	if !useReceiveMTLS {
+		externalPaths = append(externalPaths, "/metrics/v1/receive")
+	}
 
 	internalPathJSON, _ := json.MarshalIndent(Paths{Paths: []string{"/", "/metrics", "/debug/pprof", "/healthz", "/healthz/ready"}}, "", "  ")
-	externalPathJSON, _ := json.MarshalIndent(Paths{Paths: []string{"/", "/authorize", "/upload", "/healthz", "/healthz/ready", "/metrics/v1/receive"}}, "", "  ")
+	externalPathJSON, _ := json.MarshalIndent(Paths{Paths: externalPaths}, "", "  ")
 
 	internal.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		if req.URL.Path == "/" && req.Method == "GET" {
@@ -429,19 +488,39 @@ func (o *Options) Run() error {
 		v2AuthorizeClient.Transport = cache.NewRoundTripper(mc, tollbooth.ExtractToken, v2AuthorizeClient.Transport, l, prometheus.DefaultRegisterer)
 	}
 
-	external.Handle("/metrics/v1/receive",
-		telemeter_http.NewInstrumentedHandler("receive",
-			authorize.NewHandler(o.Logger, &v2AuthorizeClient, authorizeURL, o.TenantKey,
+	// CardinalityLimit runs closest to Receive so it caps what's actually
+	// forwarded to Thanos, after Whitelist/Elide have had a chance to shrink
+	// the request.
+	v2CardinalityLimited := receive.CardinalityLimit(o.ReceiveMaxSeries, o.ReceiveMaxSamples, http.HandlerFunc(receiver.Receive))
+	v2Elided := receive.Elide(o.ElideLabels, v2CardinalityLimited)
+	v2Whitelisted, err := receive.Whitelist(o.Whitelist, v2Elided)
+	if err != nil {
+		return fmt.Errorf("--whitelist: %v", err)
+	}
+	v2Validated := receive.ValidateLabels(v2Whitelisted, "__name__", o.PartitionKey) // TODO: Enforce the same labels for v1 and v2
+
+	receiveHandler := telemeter_http.NewInstrumentedHandler("receive",
+		authorize.NewHandler(o.Logger, &v2AuthorizeClient, authorizeURL, o.TenantKey,
+			receive.RateLimit(o.ReceiveRatelimit,
 				receive.LimitBodySize(receive.RequestLimit,
-					receive.ValidateLabels(
-						http.HandlerFunc(receiver.Receive),
-						"__name__", o.PartitionKey, // TODO: Enforce the same labels for v1 and v2
+					receive.Decode(
+						v2Validated,
 					),
 				),
 			),
 		),
 	)
 
+	// When a client CA bundle is configured, /metrics/v1/receive is served
+	// from its own listener instead of external's, so that requiring a
+	// client certificate at the TLS handshake doesn't also lock out
+	// ordinary callers of /, /authorize and /upload on the shared listener.
+	receiveMux := external
+	if useReceiveMTLS {
+		receiveMux = http.NewServeMux()
+	}
+	receiveMux.Handle("/metrics/v1/receive", receiveHandler)
+
 	level.Info(o.Logger).Log("msg", "starting telemeter-server", "listen", o.Listen, "internal", o.ListenInternal)
 
 	internalListener, err := net.Listen("tcp", o.ListenInternal)
@@ -452,6 +531,61 @@ func (o *Options) Run() error {
 	if err != nil {
 		return err
 	}
+	var receiveListener net.Listener
+	if useReceiveMTLS {
+		receiveListener, err = net.Listen("tcp", o.ListenReceiveMTLS)
+		if err != nil {
+			return err
+		}
+		level.Info(o.Logger).Log("msg", "serving /metrics/v1/receive with required client certificates", "listen-receive-mtls", o.ListenReceiveMTLS)
+	}
+
+	var internalTLSConfig, externalTLSConfig, receiveTLSConfig *tlsconfig.DynamicConfig
+	if useInternalTLS {
+		internalTLSConfig, err = tlsconfig.New(o.Logger, o.InternalTLSCertificatePath, o.InternalTLSKeyPath, "")
+		if err != nil {
+			return fmt.Errorf("unable to load internal TLS certificate: %v", err)
+		}
+		defer internalTLSConfig.Close()
+		internalListener = tls.NewListener(internalListener, internalTLSConfig.TLSConfig())
+	}
+	if useTLS {
+		externalTLSConfig, err = tlsconfig.New(o.Logger, o.TLSCertificatePath, o.TLSKeyPath, "")
+		if err != nil {
+			return fmt.Errorf("unable to load external TLS certificate: %v", err)
+		}
+		defer externalTLSConfig.Close()
+		externalListener = tls.NewListener(externalListener, externalTLSConfig.TLSConfig())
+	}
+	if useReceiveMTLS {
+		// useReceiveMTLS requires useTLS (validated above), so externalTLSConfig
+		// is already watching o.TLSCertificatePath/o.TLSKeyPath; share that
+		// instead of starting a second watcher on the same files and layer the
+		// client CA bundle on top.
+		receiveTLSConfig, err = tlsconfig.NewSharedCert(o.Logger, externalTLSConfig, o.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("unable to load receive mTLS client CA bundle: %v", err)
+		}
+		defer receiveTLSConfig.Close()
+		receiveListener = tls.NewListener(receiveListener, receiveTLSConfig.TLSConfig())
+	}
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			level.Info(o.Logger).Log("msg", "received SIGHUP, forcing TLS reload")
+			if internalTLSConfig != nil {
+				internalTLSConfig.ForceReload()
+			}
+			if externalTLSConfig != nil {
+				externalTLSConfig.ForceReload()
+			}
+			if receiveTLSConfig != nil {
+				receiveTLSConfig.ForceReload()
+			}
+		}
+	}()
 
 	var g run.Group
 	{
@@ -460,16 +594,9 @@ func (o *Options) Run() error {
 			s := &http.Server{
 				Handler: internal,
 			}
-			if useInternalTLS {
-				if err := s.ServeTLS(internalListener, o.InternalTLSCertificatePath, o.InternalTLSKeyPath); err != nil && err != http.ErrServerClosed {
-					level.Error(o.Logger).Log("msg", "internal HTTPS server exited", "err", err)
-					return err
-				}
-			} else {
-				if err := s.Serve(internalListener); err != nil && err != http.ErrServerClosed {
-					level.Error(o.Logger).Log("msg", "internal HTTP server exited", "err", err)
-					return err
-				}
+			if err := s.Serve(internalListener); err != nil && err != http.ErrServerClosed {
+				level.Error(o.Logger).Log("msg", "internal server exited", "err", err)
+				return err
 			}
 			return nil
 		}, func(error) {
@@ -483,16 +610,9 @@ func (o *Options) Run() error {
 			s := &http.Server{
 				Handler: external,
 			}
-			if useTLS {
-				if err := s.ServeTLS(externalListener, o.TLSCertificatePath, o.TLSKeyPath); err != nil && err != http.ErrServerClosed {
-					level.Error(o.Logger).Log("msg", "external HTTPS server exited", "err", err)
-					return err
-				}
-			} else {
-				if err := s.Serve(externalListener); err != nil && err != http.ErrServerClosed {
-					level.Error(o.Logger).Log("msg", "external HTTP server exited", "err", err)
-					return err
-				}
+			if err := s.Serve(externalListener); err != nil && err != http.ErrServerClosed {
+				level.Error(o.Logger).Log("msg", "external server exited", "err", err)
+				return err
 			}
 			return nil
 		}, func(error) {
@@ -500,6 +620,38 @@ func (o *Options) Run() error {
 		})
 	}
 
+	if useReceiveMTLS {
+		// Run the /metrics/v1/receive mTLS server.
+		g.Add(func() error {
+			s := &http.Server{
+				Handler: receiveMux,
+			}
+			if err := s.Serve(receiveListener); err != nil && err != http.ErrServerClosed {
+				level.Error(o.Logger).Log("msg", "receive mTLS server exited", "err", err)
+				return err
+			}
+			return nil
+		}, func(error) {
+			receiveListener.Close()
+		})
+	}
+
+	{
+		// Drain the forward queue once any other actor in the group exits.
+		closeCh := make(chan struct{})
+		g.Add(func() error {
+			<-closeCh
+			return nil
+		}, func(error) {
+			close(closeCh)
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := receiver.Close(ctx); err != nil {
+				level.Error(o.Logger).Log("msg", "failed to drain forward queue", "err", err)
+			}
+		})
+	}
+
 	return g.Run()
 }
 
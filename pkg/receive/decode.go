@@ -0,0 +1,71 @@
+package receive
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+type contextKey int
+
+// decodedRequestKey is the context key under which Decode stores a
+// *DecodedRequest for downstream middlewares to consume.
+const decodedRequestKey contextKey = iota
+
+// DecodedRequest holds a remote-write request's raw (snappy-compressed) bytes
+// alongside its decoded form, so that downstream middlewares don't each have
+// to read and decode the body independently.
+type DecodedRequest struct {
+	Body         []byte
+	WriteRequest *prompb.WriteRequest
+	Len          int
+}
+
+// Decode reads and snappy-decodes a remote-write request body once, attaching
+// the result to the request context as a *DecodedRequest for next (and any
+// middlewares it wraps) to consume via DecodedRequestFrom. The raw body is
+// restored onto r.Body so handlers that don't care about the decoded value
+// can still read it directly.
+func Decode(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusInternalServerError)
+			return
+		}
+		r.Body.Close()
+
+		content, err := snappy.Decode(nil, body)
+		if err != nil {
+			http.Error(w, "failed to decode request body", http.StatusBadRequest)
+			return
+		}
+
+		var wreq prompb.WriteRequest
+		if err := proto.Unmarshal(content, &wreq); err != nil {
+			http.Error(w, "failed to decode protobuf from body", http.StatusBadRequest)
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), decodedRequestKey, &DecodedRequest{
+			Body:         body,
+			WriteRequest: &wreq,
+			Len:          len(body),
+		}))
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// DecodedRequestFrom returns the *DecodedRequest attached to ctx by Decode,
+// if any.
+func DecodedRequestFrom(ctx context.Context) (*DecodedRequest, bool) {
+	dr, ok := ctx.Value(decodedRequestKey).(*DecodedRequest)
+	return dr, ok
+}
@@ -3,17 +3,20 @@ package receive
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
-	"github.com/gogo/protobuf/proto"
-	"github.com/golang/snappy"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/prometheus/prompb"
 
 	"github.com/openshift/telemeter/pkg/authorize"
 )
@@ -21,45 +24,191 @@ import (
 const forwardTimeout = 5 * time.Second
 const RequestLimit = 15 * 1024 // based on historic Prometheus data with 6KB at most
 
+// maxRetryElapsed bounds the total time spent retrying a single forward when
+// the incoming request's context carries no deadline of its own.
+const maxRetryElapsed = 30 * time.Second
+
 // ClusterAuthorizer authorizes a cluster by its token and id, returning a subject or error
 type ClusterAuthorizer interface {
 	AuthorizeCluster(token, cluster string) (subject string, err error)
 }
 
+// RetryConfig controls how Handler.Receive retries a failed forward.
+type RetryConfig struct {
+	// MaxRetries is the maximum number of additional attempts after the
+	// initial one. A value of 0 disables retrying.
+	MaxRetries int
+	// InitialBackoff is the base delay before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between retries.
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryConfig holds the server's default retry settings. NewHandler
+// always uses the RetryConfig it is given; a zero RetryConfig disables
+// retrying.
+var DefaultRetryConfig = RetryConfig{
+	MaxRetries:     4,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+}
+
 // Handler knows the forwardURL for all requests
 type Handler struct {
 	ForwardURL string
 	client     *http.Client
 	logger     log.Logger
+	retry      RetryConfig
+
+	// queue is sharded across the dispatcher pool by tenant, so that every
+	// request from a given tenant always lands on the same shard. Each shard
+	// is drained by exactly one dispatchLoop goroutine, which guarantees
+	// forwards for that tenant are dispatched in the order Receive enqueued
+	// them even though different tenants are forwarded concurrently.
+	queue                []chan *forwardJob
+	highWaterMark        int
+	maxInflightPerTenant int
+
+	closeMu sync.RWMutex
+	closed  bool
+	wg      sync.WaitGroup
+
+	tenantMu       sync.Mutex
+	tenantInflight map[string]int
 
 	// Metrics.
-	forwardRequestsTotal *prometheus.CounterVec
+	forwardRequestsTotal    *prometheus.CounterVec
+	forwardRetriesTotal     *prometheus.CounterVec
+	forwardRetryCount       prometheus.Histogram
+	forwardQueueDepth       prometheus.Gauge
+	forwardInflight         prometheus.Gauge
+	forwardDispatchDuration prometheus.Histogram
 }
 
-// NewHandler returns a new Handler with a http client
-func NewHandler(logger log.Logger, forwardURL string, reg prometheus.Registerer) *Handler {
+// NewHandler returns a new Handler with a http client. Incoming requests are
+// enqueued to a bounded, per-tenant-sharded set of channels and drained by a
+// pool of dispatcher goroutines, one per shard, which preserves per-tenant
+// forwarding order; maxInflightPerTenant (0 for unlimited) caps the number of
+// forwards a single tenant may have queued or in-flight at once.
+func NewHandler(logger log.Logger, forwardURL string, reg prometheus.Registerer, retry RetryConfig, queueSize, workers, maxInflightPerTenant int) *Handler {
+	if workers < 1 {
+		workers = 1
+	}
+	shardSize := queueSize / workers
+	if shardSize < 1 {
+		shardSize = 1
+	}
+	queue := make([]chan *forwardJob, workers)
+	for i := range queue {
+		queue[i] = make(chan *forwardJob, shardSize)
+	}
+
 	h := &Handler{
 		ForwardURL: forwardURL,
 		client: &http.Client{
 			Timeout: forwardTimeout,
 		},
-		logger: log.With(logger, "component", "receive/handler"),
+		logger:               log.With(logger, "component", "receive/handler"),
+		retry:                retry,
+		queue:                queue,
+		highWaterMark:        highWaterMark(shardSize),
+		maxInflightPerTenant: maxInflightPerTenant,
+		tenantInflight:       make(map[string]int),
 		forwardRequestsTotal: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "telemeter_forward_requests_total",
 				Help: "The number of forwarded remote-write requests.",
 			}, []string{"result"},
 		),
+		forwardRetriesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "telemeter_forward_retries_total",
+				Help: "Forward retry outcomes: retry counts each retried attempt, success counts forwards that succeeded after at least one retry, failure counts every forward that ultimately failed.",
+			}, []string{"result"},
+		),
+		forwardRetryCount: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "telemeter_forward_retry_count",
+				Help:    "The number of retries needed for a forward that eventually succeeded.",
+				Buckets: prometheus.LinearBuckets(0, 1, 8),
+			},
+		),
+		forwardQueueDepth: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "telemeter_forward_queue_depth",
+				Help: "The number of forward requests currently queued for dispatch.",
+			},
+		),
+		forwardInflight: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "telemeter_forward_inflight",
+				Help: "The number of forward requests currently queued or being dispatched.",
+			},
+		),
+		forwardDispatchDuration: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "telemeter_forward_dispatch_duration_seconds",
+				Help:    "Time spent dispatching a forward request, including retries.",
+				Buckets: prometheus.DefBuckets,
+			},
+		),
 	}
 
 	if reg != nil {
-		reg.MustRegister(h.forwardRequestsTotal)
+		reg.MustRegister(
+			h.forwardRequestsTotal,
+			h.forwardRetriesTotal,
+			h.forwardRetryCount,
+			h.forwardQueueDepth,
+			h.forwardInflight,
+			h.forwardDispatchDuration,
+		)
+	}
+
+	h.wg.Add(workers)
+	for i := range h.queue {
+		go h.dispatchLoop(h.queue[i])
 	}
 
 	return h
 }
 
-// Receive a remote-write request after it has been authenticated and forward it to Thanos
+// highWaterMark returns the queue depth at or above which Receive starts rejecting
+// new work with a 429, leaving headroom for requests already admitted.
+func highWaterMark(queueSize int) int {
+	if queueSize <= 0 {
+		return 0
+	}
+	if hwm := int(float64(queueSize) * 0.9); hwm > 0 {
+		return hwm
+	}
+	return queueSize
+}
+
+// shardFor returns the index of the queue shard that all requests from
+// tenant must use, so that a single dispatchLoop goroutine processes them in
+// the order they were enqueued.
+func (h *Handler) shardFor(tenant string) int {
+	if len(h.queue) == 1 {
+		return 0
+	}
+	sum := fnv.New32a()
+	sum.Write([]byte(tenant))
+	return int(sum.Sum32() % uint32(len(h.queue)))
+}
+
+// queueDepth returns the total number of jobs currently queued across all
+// shards, for reporting via forwardQueueDepth.
+func (h *Handler) queueDepth() int {
+	total := 0
+	for _, q := range h.queue {
+		total += len(q)
+	}
+	return total
+}
+
+// Receive a remote-write request after it has been authenticated, enqueueing
+// it for forwarding to Thanos by the dispatcher pool.
 func (h *Handler) Receive(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -67,35 +216,246 @@ func (h *Handler) Receive(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	ctx, cancel := context.WithTimeout(r.Context(), forwardTimeout)
+	var body []byte
+	if dr, ok := DecodedRequestFrom(r.Context()); ok {
+		body = dr.Body
+	} else {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			level.Error(h.logger).Log("msg", "failed to buffer request body", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body = b
+	}
+
+	tenant, _ := r.Context().Value(authorize.TenantKey).(string)
+	requestID := requestIDFor(body)
+
+	deadline := time.Now().Add(maxRetryElapsed)
+	if d, ok := r.Context().Deadline(); ok {
+		deadline = d
+	}
+	ctx, cancel := context.WithDeadline(r.Context(), deadline)
 	defer cancel()
 
-	req, err := http.NewRequest(http.MethodPost, h.ForwardURL, r.Body)
-	if err != nil {
-		level.Error(h.logger).Log("msg", "failed to create forward request", "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	h.closeMu.RLock()
+	if h.closed {
+		h.closeMu.RUnlock()
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
 		return
 	}
-	req = req.WithContext(ctx)
-	req.Header.Add("THANOS-TENANT", r.Context().Value(authorize.TenantKey).(string))
 
-	resp, err := h.client.Do(req)
-	if err != nil {
-		h.forwardRequestsTotal.WithLabelValues("error").Inc()
-		level.Error(h.logger).Log("msg", "failed to forward request", "err", err)
-		http.Error(w, err.Error(), http.StatusBadGateway)
+	shard := h.shardFor(tenant)
+
+	if h.highWaterMark > 0 && len(h.queue[shard]) >= h.highWaterMark {
+		h.closeMu.RUnlock()
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "forward queue is full, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	if h.maxInflightPerTenant > 0 && !h.admitTenant(tenant) {
+		h.closeMu.RUnlock()
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, fmt.Sprintf("tenant %q has reached the maximum number of in-flight forwards", tenant), http.StatusTooManyRequests)
+		return
+	}
+
+	job := &forwardJob{
+		ctx:       ctx,
+		body:      body,
+		tenant:    tenant,
+		requestID: requestID,
+		result:    make(chan forwardResult, 1),
+	}
+
+	select {
+	case h.queue[shard] <- job:
+		h.forwardQueueDepth.Set(float64(h.queueDepth()))
+		h.forwardInflight.Inc()
+	case <-r.Context().Done():
+		h.closeMu.RUnlock()
+		h.releaseTenant(tenant)
+		http.Error(w, r.Context().Err().Error(), http.StatusGatewayTimeout)
 		return
 	}
+	h.closeMu.RUnlock()
+
+	select {
+	case res := <-job.result:
+		if res.err != nil {
+			status := res.statusCode
+			if status == 0 {
+				status = http.StatusBadGateway
+			}
+			http.Error(w, res.err.Error(), status)
+			return
+		}
+		w.WriteHeader(res.statusCode)
+	case <-r.Context().Done():
+		http.Error(w, r.Context().Err().Error(), http.StatusGatewayTimeout)
+	}
+}
+
+// admitTenant reserves an in-flight slot for tenant, returning false if the
+// tenant is already at its cap.
+func (h *Handler) admitTenant(tenant string) bool {
+	h.tenantMu.Lock()
+	defer h.tenantMu.Unlock()
+
+	if h.tenantInflight[tenant] >= h.maxInflightPerTenant {
+		return false
+	}
+	h.tenantInflight[tenant]++
+	return true
+}
+
+// releaseTenant frees the in-flight slot reserved by admitTenant.
+func (h *Handler) releaseTenant(tenant string) {
+	h.tenantMu.Lock()
+	defer h.tenantMu.Unlock()
+
+	h.tenantInflight[tenant]--
+	if h.tenantInflight[tenant] <= 0 {
+		delete(h.tenantInflight, tenant)
+	}
+}
+
+// forward performs the retryable forward of a queued job, returning the
+// outcome to be reported back to the waiting Receive call.
+func (h *Handler) forward(job *forwardJob) forwardResult {
+	var resp *http.Response
+	var lastErr error
+	attempts := 0
+
+	for {
+		resp, lastErr = h.doForward(job.ctx, job.body, job.tenant, job.requestID)
+
+		retryable, retryAfter := h.shouldRetry(resp, lastErr)
+		if !retryable || attempts >= h.retry.MaxRetries {
+			break
+		}
+
+		backoff := h.backoffFor(attempts, retryAfter)
+		select {
+		case <-job.ctx.Done():
+			if lastErr == nil {
+				lastErr = job.ctx.Err()
+			}
+			retryable = false
+		case <-time.After(backoff):
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+			resp = nil
+		}
+		if !retryable {
+			break
+		}
+
+		h.forwardRetriesTotal.WithLabelValues("retry").Inc()
+		attempts++
+	}
+
+	if lastErr != nil {
+		h.forwardRequestsTotal.WithLabelValues("error").Inc()
+		h.forwardRetriesTotal.WithLabelValues("failure").Inc()
+		level.Error(h.logger).Log("msg", "failed to forward request", "request_id", job.requestID, "attempts", attempts, "err", lastErr)
+		return forwardResult{err: lastErr, attempts: attempts}
+	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode/100 != 2 {
 		msg := "upstream response status is not 200 OK"
 		h.forwardRequestsTotal.WithLabelValues("error").Inc()
-		level.Error(h.logger).Log("msg", msg, "statuscode", resp.Status)
-		http.Error(w, msg, resp.StatusCode)
-		return
+		h.forwardRetriesTotal.WithLabelValues("failure").Inc()
+		level.Error(h.logger).Log("msg", msg, "request_id", job.requestID, "attempts", attempts, "statuscode", resp.Status)
+		return forwardResult{statusCode: resp.StatusCode, err: fmt.Errorf(msg), attempts: attempts}
+	}
+
+	if attempts > 0 {
+		h.forwardRetriesTotal.WithLabelValues("success").Inc()
 	}
+	h.forwardRetryCount.Observe(float64(attempts))
 	h.forwardRequestsTotal.WithLabelValues("success").Inc()
-	w.WriteHeader(resp.StatusCode)
+	return forwardResult{statusCode: resp.StatusCode, attempts: attempts}
+}
+
+// doForward issues a single forward attempt, reusing the buffered body bytes.
+func (h *Handler) doForward(ctx context.Context, body []byte, tenant, requestID string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, h.ForwardURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create forward request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Add("THANOS-TENANT", tenant)
+	req.Header.Add("THANOS-REQUEST-ID", requestID)
+
+	return h.client.Do(req)
+}
+
+// shouldRetry decides whether a forward attempt is retryable, and if so,
+// how long the upstream asked us to wait via Retry-After.
+func (h *Handler) shouldRetry(resp *http.Response, err error) (retryable bool, retryAfter time.Duration) {
+	if err != nil {
+		// Network-level errors (timeouts, connection refused, etc.) are retryable.
+		return true, 0
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode/100 == 5:
+		return true, parseRetryAfter(resp.Header.Get("Retry-After"))
+	case resp.StatusCode/100 == 4:
+		return false, 0
+	default:
+		return false, 0
+	}
+}
+
+// backoffFor computes the exponential backoff with full jitter for the given
+// attempt, honoring an upstream Retry-After if one was provided.
+func (h *Handler) backoffFor(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		if retryAfter > h.retry.MaxBackoff {
+			return h.retry.MaxBackoff
+		}
+		return retryAfter
+	}
+
+	base := h.retry.InitialBackoff << uint(attempt)
+	if base <= 0 || base > h.retry.MaxBackoff {
+		base = h.retry.MaxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(base) + 1))
+}
+
+// parseRetryAfter parses the Retry-After header in either its delta-seconds
+// or HTTP-date form, returning 0 if the header is absent or invalid.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// requestIDFor derives a stable identifier for a forwarded request body, used
+// to correlate retries across logs.
+func requestIDFor(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])[:12]
 }
 
 func LimitBodySize(limit int64, next http.Handler) http.HandlerFunc {
@@ -119,7 +479,8 @@ func LimitBodySize(limit int64, next http.Handler) http.HandlerFunc {
 // ErrRequiredLabelMissing is returned if a required label is missing from a metric
 var ErrRequiredLabelMissing = fmt.Errorf("a required label is missing from the metric")
 
-// ValidateLabels by checking each enforced label to be present in every time series
+// ValidateLabels by checking each enforced label to be present in every time
+// series of the request's pre-decoded WriteRequest. It must run after Decode.
 func ValidateLabels(next http.Handler, labels ...string) http.HandlerFunc {
 	labelmap := make(map[string]struct{})
 	for _, label := range labels {
@@ -127,30 +488,13 @@ func ValidateLabels(next http.Handler, labels ...string) http.HandlerFunc {
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-
-		bodyBytes, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, "failed to read body", http.StatusInternalServerError)
-			return
-		}
-		r.Body.Close()
-
-		r.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
-		body, err := ioutil.ReadAll(r.Body)
-
-		content, err := snappy.Decode(nil, body)
-		if err != nil {
-			http.Error(w, "failed to decode request body", http.StatusBadRequest)
-			return
-		}
-
-		var wreq prompb.WriteRequest
-		if err := proto.Unmarshal(content, &wreq); err != nil {
-			http.Error(w, "failed to decode protobuf from body", http.StatusBadRequest)
+		dr, ok := DecodedRequestFrom(r.Context())
+		if !ok {
+			http.Error(w, "request was not decoded, ValidateLabels must run after Decode", http.StatusInternalServerError)
 			return
 		}
 
-		for _, ts := range wreq.GetTimeseries() {
+		for _, ts := range dr.WriteRequest.GetTimeseries() {
 			// exit early if not enough labels anyway
 			if len(ts.GetLabels()) < len(labels) {
 				http.Error(w, ErrRequiredLabelMissing.Error(), http.StatusBadRequest)
@@ -0,0 +1,235 @@
+package receive
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+// newTestHandler builds a Handler wired to forward to upstream, with no
+// metrics registerer so handlers built by different tests don't collide on
+// metric names.
+func newTestHandler(upstream string, retry RetryConfig, queueSize, workers, maxInflightPerTenant int) *Handler {
+	return NewHandler(log.NewNopLogger(), upstream, nil, retry, queueSize, workers, maxInflightPerTenant)
+}
+
+func receiveRequest(tenant, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/metrics/v1/receive", strings.NewReader(body))
+	return r.WithContext(context.WithValue(r.Context(), authorize.TenantKey, tenant))
+}
+
+func TestHandlerReceiveForwardsSuccessfully(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(upstream.URL, RetryConfig{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}, 10, 2, 0)
+	defer h.Close(context.Background())
+
+	rec := httptest.NewRecorder()
+	h.Receive(rec, receiveRequest("tenant-a", "body"))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+}
+
+func TestHandlerReceiveRetriesThenSucceeds(t *testing.T) {
+	var attempts int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(upstream.URL, RetryConfig{MaxRetries: 3, InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}, 10, 1, 0)
+	defer h.Close(context.Background())
+
+	rec := httptest.NewRecorder()
+	h.Receive(rec, receiveRequest("tenant-a", "body"))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the forward to eventually succeed with status %d, got %d", http.StatusOK, rec.Code)
+	}
+	if got := atomic.LoadInt32(&attempts); got != 3 {
+		t.Errorf("expected upstream to be called 3 times (2 failures + 1 success), got %d", got)
+	}
+}
+
+func TestHandlerReceiveRejectsTenantOverInflightCap(t *testing.T) {
+	started := make(chan struct{})
+	var startedOnce sync.Once
+	release := make(chan struct{})
+	// The second (same-tenant) and third (other-tenant) jobs may also reach
+	// this handler once release is closed below; startedOnce keeps the
+	// "signal first arrival" close(started) safe to call more than once.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startedOnce.Do(func() { close(started) })
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(upstream.URL, RetryConfig{}, 10, 1, 1)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		h.Close(ctx)
+	}()
+
+	firstDone := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		rec := httptest.NewRecorder()
+		h.Receive(rec, receiveRequest("tenant-a", "body"))
+		firstDone <- rec
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the first request to reach the upstream server")
+	}
+
+	rec := httptest.NewRecorder()
+	h.Receive(rec, receiveRequest("tenant-a", "second"))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected a second in-flight request for the same tenant to be rejected with %d, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After header to be set when rejecting for the tenant in-flight cap")
+	}
+
+	// tenant-b's admission check must succeed immediately regardless of
+	// tenant-a's cap, even though the shared single worker can't actually
+	// dispatch it until tenant-a's blocked forward releases below; run it in
+	// its own goroutine so this test doesn't deadlock on that queueing.
+	otherDone := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		rec := httptest.NewRecorder()
+		h.Receive(rec, receiveRequest("tenant-b", "body"))
+		otherDone <- rec
+	}()
+
+	close(release)
+
+	select {
+	case first := <-firstDone:
+		if first.Code != http.StatusOK {
+			t.Errorf("expected the first request to eventually succeed, got status %d", first.Code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the first request to complete")
+	}
+
+	select {
+	case other := <-otherDone:
+		if other.Code != http.StatusOK {
+			t.Errorf("expected a different tenant to be unaffected by tenant-a's cap, got status %d", other.Code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the other tenant's request to complete")
+	}
+}
+
+func TestHandlerReceiveRejectsWhenQueueFull(t *testing.T) {
+	started := make(chan struct{})
+	var startedOnce sync.Once
+	release := make(chan struct{})
+	// The second job may also reach this handler once release is closed
+	// below; startedOnce keeps close(started) safe to call more than once.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startedOnce.Do(func() { close(started) })
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	// One worker, a single-slot shard: the first request gets dispatched
+	// (blocking in the upstream handler), the second fills the now-empty
+	// shard channel, and the third must be rejected at the high-water mark.
+	h := newTestHandler(upstream.URL, RetryConfig{}, 1, 1, 0)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		h.Close(ctx)
+	}()
+	// Unblock the upstream handler (and thus the dispatcher) before Close
+	// above waits for the in-flight job to drain.
+	defer close(release)
+
+	go func() {
+		rec := httptest.NewRecorder()
+		h.Receive(rec, receiveRequest("tenant-a", "first"))
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the first request to reach the upstream server")
+	}
+
+	go func() {
+		rec := httptest.NewRecorder()
+		h.Receive(rec, receiveRequest("tenant-b", "second"))
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(h.queue[0]) < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(h.queue[0]) < 1 {
+		t.Fatal("timed out waiting for the second request to occupy the shard's queue slot")
+	}
+
+	rec := httptest.NewRecorder()
+	h.Receive(rec, receiveRequest("tenant-c", "third"))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected a request arriving at a full queue to be rejected with %d, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+}
+
+func TestHandlerCloseAfterCompletedForward(t *testing.T) {
+	var forwarded int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&forwarded, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(upstream.URL, RetryConfig{}, 10, 2, 0)
+
+	done := make(chan struct{})
+	go func() {
+		rec := httptest.NewRecorder()
+		h.Receive(rec, receiveRequest("tenant-a", "body"))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the queued request to be forwarded")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.Close(ctx); err != nil {
+		t.Fatalf("Close() failed to drain in time: %v", err)
+	}
+	if atomic.LoadInt32(&forwarded) != 1 {
+		t.Errorf("expected exactly 1 forward to reach upstream, got %d", forwarded)
+	}
+}
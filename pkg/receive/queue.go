@@ -0,0 +1,75 @@
+package receive
+
+import (
+	"context"
+	"time"
+)
+
+// forwardJob is a single buffered remote-write request waiting to be
+// dispatched to Thanos.
+type forwardJob struct {
+	ctx       context.Context
+	body      []byte
+	tenant    string
+	requestID string
+	result    chan forwardResult
+}
+
+// forwardResult is handed back to the Receive call that enqueued a forwardJob
+// once a dispatcher has attempted (and possibly retried) the forward.
+type forwardResult struct {
+	statusCode int
+	attempts   int
+	err        error
+}
+
+// dispatchLoop drains a single queue shard and forwards each job, reporting
+// the queue depth and dispatch latency as it goes. Because a shard has
+// exactly one dispatchLoop goroutine, and shardFor always routes a given
+// tenant to the same shard, jobs from that tenant are dispatched in the
+// order they were enqueued. It runs until its shard is closed by Close, at
+// which point it drains any remaining jobs before returning.
+func (h *Handler) dispatchLoop(queue chan *forwardJob) {
+	defer h.wg.Done()
+
+	for job := range queue {
+		h.forwardQueueDepth.Set(float64(h.queueDepth()))
+
+		start := time.Now()
+		result := h.forward(job)
+		h.forwardDispatchDuration.Observe(time.Since(start).Seconds())
+
+		h.releaseTenant(job.tenant)
+		h.forwardInflight.Dec()
+
+		select {
+		case job.result <- result:
+		default:
+			// Receive already gave up waiting; drop the result.
+		}
+	}
+}
+
+// Close stops accepting new work and waits for the dispatcher pool to drain
+// the queue, or for ctx to expire, whichever comes first.
+func (h *Handler) Close(ctx context.Context) error {
+	h.closeMu.Lock()
+	h.closed = true
+	for _, q := range h.queue {
+		close(q)
+	}
+	h.closeMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,69 @@
+package receive
+
+import "testing"
+
+func TestAdmitAndReleaseTenant(t *testing.T) {
+	h := &Handler{maxInflightPerTenant: 2, tenantInflight: make(map[string]int)}
+
+	if !h.admitTenant("a") {
+		t.Fatal("expected first admission for tenant a to succeed")
+	}
+	if !h.admitTenant("a") {
+		t.Fatal("expected second admission for tenant a to succeed")
+	}
+	if h.admitTenant("a") {
+		t.Fatal("expected third admission for tenant a to be rejected at the cap")
+	}
+	if !h.admitTenant("b") {
+		t.Fatal("expected tenant b's admission to be unaffected by tenant a's cap")
+	}
+
+	h.releaseTenant("a")
+	if !h.admitTenant("a") {
+		t.Fatal("expected admission for tenant a to succeed again after a release")
+	}
+	h.releaseTenant("nonexistent")
+	if _, ok := h.tenantInflight["nonexistent"]; ok {
+		t.Fatal("releaseTenant must not create entries for tenants it wasn't tracking")
+	}
+}
+
+func TestHighWaterMark(t *testing.T) {
+	cases := []struct {
+		queueSize int
+		want      int
+	}{
+		{0, 0},
+		{1, 1},
+		{10, 9},
+		{1000, 900},
+	}
+	for _, c := range cases {
+		if got := highWaterMark(c.queueSize); got != c.want {
+			t.Errorf("highWaterMark(%d) = %d, want %d", c.queueSize, got, c.want)
+		}
+	}
+}
+
+func TestShardForIsStablePerTenant(t *testing.T) {
+	h := &Handler{queue: make([]chan *forwardJob, 4)}
+
+	for _, tenant := range []string{"tenant-a", "tenant-b", "tenant-c"} {
+		first := h.shardFor(tenant)
+		for i := 0; i < 10; i++ {
+			if got := h.shardFor(tenant); got != first {
+				t.Fatalf("shardFor(%q) = %d on call %d, want stable %d", tenant, got, i, first)
+			}
+		}
+	}
+}
+
+func TestShardForSingleShardAlwaysZero(t *testing.T) {
+	h := &Handler{queue: make([]chan *forwardJob, 1)}
+
+	for _, tenant := range []string{"a", "b", ""} {
+		if got := h.shardFor(tenant); got != 0 {
+			t.Errorf("shardFor(%q) = %d with a single shard, want 0", tenant, got)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package receive
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+// receiveRejectedTotal counts requests rejected by RateLimit or
+// CardinalityLimit before ever reaching the forwarder.
+var receiveRejectedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "telemeter_receive_rejected_total",
+		Help: "The number of /metrics/v1/receive requests rejected before being forwarded, by tenant and reason.",
+	},
+	[]string{"tenant", "reason"},
+)
+
+func init() {
+	if err := prometheus.Register(receiveRejectedTotal); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			receiveRejectedTotal = are.ExistingCollector.(*prometheus.CounterVec)
+			return
+		}
+		panic(err)
+	}
+}
+
+// rateLimitSweepThreshold bounds how large a RateLimit instance's per-tenant
+// bookkeeping map is allowed to grow before stale entries are evicted.
+const rateLimitSweepThreshold = 10000
+
+// RateLimit rejects a tenant's request with 429 if it arrives sooner than
+// perTenant after that tenant's last accepted request. A zero perTenant
+// disables rate limiting.
+func RateLimit(perTenant time.Duration, next http.Handler) http.HandlerFunc {
+	var mu sync.Mutex
+	last := make(map[string]time.Time)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if perTenant <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tenant, _ := r.Context().Value(authorize.TenantKey).(string)
+
+		mu.Lock()
+		now := time.Now()
+		wait := perTenant - now.Sub(last[tenant])
+		if wait > 0 {
+			mu.Unlock()
+			receiveRejectedTotal.WithLabelValues(tenant, "ratelimit").Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			http.Error(w, fmt.Sprintf("tenant %q is sending requests faster than the configured rate limit of %s", tenant, perTenant), http.StatusTooManyRequests)
+			return
+		}
+		last[tenant] = now
+		if len(last) > rateLimitSweepThreshold {
+			cutoff := now.Add(-perTenant)
+			for t, seen := range last {
+				if seen.Before(cutoff) {
+					delete(last, t)
+				}
+			}
+		}
+		mu.Unlock()
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// CardinalityLimit rejects a decoded remote-write request whose series or
+// sample count exceeds the given thresholds. A zero threshold disables that
+// particular check. It must run after Decode.
+func CardinalityLimit(maxSeriesPerRequest, maxSamplesPerRequest int, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if maxSeriesPerRequest <= 0 && maxSamplesPerRequest <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		dr, ok := DecodedRequestFrom(r.Context())
+		if !ok {
+			http.Error(w, "request was not decoded, CardinalityLimit must run after Decode", http.StatusInternalServerError)
+			return
+		}
+
+		tenant, _ := r.Context().Value(authorize.TenantKey).(string)
+
+		if maxSeriesPerRequest > 0 && len(dr.WriteRequest.Timeseries) > maxSeriesPerRequest {
+			receiveRejectedTotal.WithLabelValues(tenant, "max_series").Inc()
+			http.Error(w, fmt.Sprintf("request contains %d time series, exceeding the limit of %d", len(dr.WriteRequest.Timeseries), maxSeriesPerRequest), http.StatusBadRequest)
+			return
+		}
+
+		if maxSamplesPerRequest > 0 {
+			samples := 0
+			for _, ts := range dr.WriteRequest.Timeseries {
+				samples += len(ts.GetSamples())
+			}
+			if samples > maxSamplesPerRequest {
+				receiveRejectedTotal.WithLabelValues(tenant, "max_samples").Inc()
+				http.Error(w, fmt.Sprintf("request contains %d samples, exceeding the limit of %d", samples, maxSamplesPerRequest), http.StatusBadRequest)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,125 @@
+package receive
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+func requestForTenant(tenant string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/metrics/v1/receive", nil)
+	return r.WithContext(context.WithValue(r.Context(), authorize.TenantKey, tenant))
+}
+
+func TestRateLimitRejectsRapidRequests(t *testing.T) {
+	var calls int
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { calls++ })
+	handler := RateLimit(time.Minute, next)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, requestForTenant("tenant-a"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected first request to be accepted, got status %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, requestForTenant("tenant-a"))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected second immediate request to be rate limited, got status %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After header to be set on a rate-limited response")
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, requestForTenant("tenant-b"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected a different tenant's request to be unaffected, got status %d", rec.Code)
+	}
+
+	if calls != 2 {
+		t.Errorf("expected next handler to be called twice, got %d", calls)
+	}
+}
+
+func TestRateLimitDisabledWhenZero(t *testing.T) {
+	var calls int
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { calls++ })
+	handler := RateLimit(0, next)
+
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, requestForTenant("tenant-a"))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected request %d to be accepted with rate limiting disabled, got status %d", i, rec.Code)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("expected next handler to be called 3 times, got %d", calls)
+	}
+}
+
+func TestCardinalityLimitRejectsTooManySeries(t *testing.T) {
+	wreq := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{{}, {}, {}},
+	}
+
+	var called bool
+	handler := CardinalityLimit(2, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, decodedRequest(t, wreq))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+	if called {
+		t.Error("expected next handler not to be called when the series limit is exceeded")
+	}
+}
+
+func TestCardinalityLimitRejectsTooManySamples(t *testing.T) {
+	wreq := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{Samples: []prompb.Sample{{Value: 1}, {Value: 2}}},
+			{Samples: []prompb.Sample{{Value: 3}}},
+		},
+	}
+
+	var called bool
+	handler := CardinalityLimit(0, 2, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, decodedRequest(t, wreq))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+	if called {
+		t.Error("expected next handler not to be called when the sample limit is exceeded")
+	}
+}
+
+func TestCardinalityLimitAllowsWithinThresholds(t *testing.T) {
+	wreq := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{Samples: []prompb.Sample{{Value: 1}}},
+		},
+	}
+
+	var called bool
+	handler := CardinalityLimit(5, 5, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, decodedRequest(t, wreq))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	if !called {
+		t.Error("expected next handler to be called when within thresholds")
+	}
+}
@@ -0,0 +1,89 @@
+package receive
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want time.Duration
+	}{
+		{"empty", "", 0},
+		{"invalid", "not-a-date", 0},
+		{"delta-seconds", "5", 5 * time.Second},
+		{"negative delta-seconds", "-5", 0},
+		{"http-date in the past", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := parseRetryAfter(c.in); got != c.want {
+				t.Errorf("parseRetryAfter(%q) = %v, want %v", c.in, got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfterHTTPDate(t *testing.T) {
+	want := 30 * time.Second
+	in := time.Now().Add(want).UTC().Format(http.TimeFormat)
+
+	got := parseRetryAfter(in)
+	if got <= 0 || got > want+time.Second {
+		t.Errorf("parseRetryAfter(%q) = %v, want roughly %v", in, got, want)
+	}
+}
+
+func TestHandlerShouldRetry(t *testing.T) {
+	h := &Handler{}
+
+	cases := []struct {
+		name         string
+		resp         *http.Response
+		err          error
+		wantRetry    bool
+		wantRetryFor bool // whether a Retry-After was honored
+	}{
+		{"network error", nil, errors.New("boom"), true, false},
+		{"429", &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"2"}}}, nil, true, true},
+		{"503", &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}}, nil, true, false},
+		{"404", &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{}}, nil, false, false},
+		{"200", &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}, nil, false, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			retryable, retryAfter := h.shouldRetry(c.resp, c.err)
+			if retryable != c.wantRetry {
+				t.Errorf("shouldRetry() retryable = %v, want %v", retryable, c.wantRetry)
+			}
+			if (retryAfter > 0) != c.wantRetryFor {
+				t.Errorf("shouldRetry() retryAfter = %v, wantRetryFor = %v", retryAfter, c.wantRetryFor)
+			}
+		})
+	}
+}
+
+func TestHandlerBackoffForHonorsRetryAfter(t *testing.T) {
+	h := &Handler{retry: RetryConfig{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second}}
+
+	if got := h.backoffFor(0, 3*time.Second); got != 3*time.Second {
+		t.Errorf("backoffFor(0, 3s) = %v, want 3s", got)
+	}
+	if got := h.backoffFor(0, 30*time.Second); got != h.retry.MaxBackoff {
+		t.Errorf("backoffFor(0, 30s) = %v, want capped at MaxBackoff %v", got, h.retry.MaxBackoff)
+	}
+}
+
+func TestHandlerBackoffForCapsAtMaxBackoff(t *testing.T) {
+	h := &Handler{retry: RetryConfig{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}}
+
+	for attempt := 0; attempt < 10; attempt++ {
+		if got := h.backoffFor(attempt, 0); got > h.retry.MaxBackoff {
+			t.Errorf("backoffFor(%d, 0) = %v, want <= MaxBackoff %v", attempt, got, h.retry.MaxBackoff)
+		}
+	}
+}
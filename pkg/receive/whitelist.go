@@ -0,0 +1,165 @@
+package receive
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Whitelist drops time series from a decoded remote-write request whose
+// labels don't match any of the given rules. Each rule is a PromQL metric
+// selector (e.g. `up` or `{__name__=~"node_.+"}`), the same selector syntax
+// accepted by metricfamily.NewWhitelist on the v1 /upload path. Matching is
+// reimplemented here rather than shared with that package because
+// metricfamily.Transformer operates on clientmodel.MetricFamily while this
+// operates directly on the remote-write wire format (prompb.TimeSeries); both
+// implementations parse rules with promql.ParseMetricSelector and evaluate
+// them with labels.Matcher, so policy stays equivalent, but a rule accepted
+// or rejected differently by one needs fixing in both. It must run after
+// Decode.
+func Whitelist(rules []string, next http.Handler) (http.HandlerFunc, error) {
+	groups, err := parseSelectorGroups(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(groups) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		dr, ok := DecodedRequestFrom(r.Context())
+		if !ok {
+			http.Error(w, "request was not decoded, Whitelist must run after Decode", http.StatusInternalServerError)
+			return
+		}
+
+		original := dr.WriteRequest.Timeseries
+		kept := original[:0]
+		for _, ts := range original {
+			if matchesAnyGroup(groups, ts.GetLabels()) {
+				kept = append(kept, ts)
+			}
+		}
+
+		if len(kept) != len(original) {
+			dr.WriteRequest.Timeseries = kept
+			if err := reencode(dr); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			r.ContentLength = int64(dr.Len)
+			r.Header.Set("Content-Length", strconv.Itoa(dr.Len))
+		}
+
+		next.ServeHTTP(w, r)
+	}, nil
+}
+
+// Elide strips the given labels from every time series of a decoded
+// remote-write request. It must run after Decode.
+func Elide(elideLabels []string, next http.Handler) http.HandlerFunc {
+	elideSet := make(map[string]struct{}, len(elideLabels))
+	for _, l := range elideLabels {
+		elideSet[l] = struct{}{}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(elideSet) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		dr, ok := DecodedRequestFrom(r.Context())
+		if !ok {
+			http.Error(w, "request was not decoded, Elide must run after Decode", http.StatusInternalServerError)
+			return
+		}
+
+		var dropped bool
+		for i := range dr.WriteRequest.Timeseries {
+			ts := &dr.WriteRequest.Timeseries[i]
+			kept := ts.Labels[:0]
+			for _, l := range ts.GetLabels() {
+				if _, drop := elideSet[l.GetName()]; drop {
+					dropped = true
+					continue
+				}
+				kept = append(kept, l)
+			}
+			ts.Labels = kept
+		}
+
+		if dropped {
+			if err := reencode(dr); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			r.ContentLength = int64(dr.Len)
+			r.Header.Set("Content-Length", strconv.Itoa(dr.Len))
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// reencode re-marshals and snappy-encodes dr.WriteRequest back into dr.Body
+// after it has been modified in place, keeping dr.Len in sync.
+func reencode(dr *DecodedRequest) error {
+	data, err := proto.Marshal(dr.WriteRequest)
+	if err != nil {
+		return fmt.Errorf("failed to re-marshal write request: %v", err)
+	}
+	dr.Body = snappy.Encode(nil, data)
+	dr.Len = len(dr.Body)
+	return nil
+}
+
+// parseSelectorGroups parses each rule as an independent PromQL metric
+// selector; a series matches if it matches any one group in full.
+func parseSelectorGroups(rules []string) ([][]*labels.Matcher, error) {
+	var groups [][]*labels.Matcher
+	for _, rule := range rules {
+		matchers, err := promql.ParseMetricSelector(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid whitelist rule %q: %v", rule, err)
+		}
+		groups = append(groups, matchers)
+	}
+	return groups, nil
+}
+
+func matchesAnyGroup(groups [][]*labels.Matcher, lbls []prompb.Label) bool {
+	for _, group := range groups {
+		if matchesAllMatchers(group, lbls) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAllMatchers(matchers []*labels.Matcher, lbls []prompb.Label) bool {
+	for _, m := range matchers {
+		if !m.Matches(labelValue(lbls, m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+func labelValue(lbls []prompb.Label, name string) string {
+	for _, l := range lbls {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
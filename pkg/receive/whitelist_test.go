@@ -0,0 +1,114 @@
+package receive
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func decodedRequest(t *testing.T, wreq *prompb.WriteRequest) *http.Request {
+	t.Helper()
+
+	data, err := proto.Marshal(wreq)
+	if err != nil {
+		t.Fatalf("failed to marshal write request: %v", err)
+	}
+	body := snappy.Encode(nil, data)
+
+	req := httptest.NewRequest(http.MethodPost, "/metrics/v1/receive", nil)
+	dr := &DecodedRequest{WriteRequest: wreq, Body: body, Len: len(body)}
+	return req.WithContext(context.WithValue(req.Context(), decodedRequestKey, dr))
+}
+
+func writeRequestFrom(t *testing.T, r *http.Request) *prompb.WriteRequest {
+	t.Helper()
+
+	dr, ok := DecodedRequestFrom(r.Context())
+	if !ok {
+		t.Fatalf("request has no DecodedRequest")
+	}
+	return dr.WriteRequest
+}
+
+func TestWhitelistDropsNonMatchingSeries(t *testing.T) {
+	wreq := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}},
+			{Labels: []prompb.Label{{Name: "__name__", Value: "down"}}},
+		},
+	}
+
+	handler, err := Whitelist([]string{"up"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kept := writeRequestFrom(t, r).GetTimeseries()
+		if len(kept) != 1 {
+			t.Fatalf("expected 1 surviving series, got %d", len(kept))
+		}
+		if kept[0].GetLabels()[0].GetValue() != "up" {
+			t.Fatalf("expected surviving series to be %q, got %q", "up", kept[0].GetLabels()[0].GetValue())
+		}
+	}))
+	if err != nil {
+		t.Fatalf("Whitelist returned error: %v", err)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), decodedRequest(t, wreq))
+}
+
+func TestWhitelistMatchesAnyRule(t *testing.T) {
+	wreq := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}},
+			{Labels: []prompb.Label{{Name: "__name__", Value: "node_cpu"}}},
+			{Labels: []prompb.Label{{Name: "__name__", Value: "other"}}},
+		},
+	}
+
+	handler, err := Whitelist([]string{"up", `{__name__=~"node_.+"}`}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kept := writeRequestFrom(t, r).GetTimeseries()
+		if len(kept) != 2 {
+			t.Fatalf("expected 2 surviving series, got %d", len(kept))
+		}
+	}))
+	if err != nil {
+		t.Fatalf("Whitelist returned error: %v", err)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), decodedRequest(t, wreq))
+}
+
+func TestWhitelistRejectsInvalidRule(t *testing.T) {
+	if _, err := Whitelist([]string{"{"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})); err == nil {
+		t.Fatal("expected an error for an invalid selector")
+	}
+}
+
+func TestElideStripsOnlyGivenLabels(t *testing.T) {
+	wreq := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{Labels: []prompb.Label{
+				{Name: "__name__", Value: "up"},
+				{Name: "_id", Value: "cluster-1"},
+				{Name: "instance", Value: "10.0.0.1"},
+			}},
+		},
+	}
+
+	handler := Elide([]string{"_id"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		labels := writeRequestFrom(t, r).GetTimeseries()[0].GetLabels()
+		if len(labels) != 2 {
+			t.Fatalf("expected 2 remaining labels, got %d", len(labels))
+		}
+		for _, l := range labels {
+			if l.GetName() == "_id" {
+				t.Fatalf("expected _id to be elided, found %v", l)
+			}
+		}
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), decodedRequest(t, wreq))
+}
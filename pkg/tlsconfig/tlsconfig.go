@@ -0,0 +1,313 @@
+// Package tlsconfig provides a *tls.Config whose certificate and CA material
+// can be rotated on disk without restarting the process holding it.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// restatInterval is how often the watcher re-reads its files even without an
+// fsnotify event, as a fallback for filesystems that don't deliver them
+// reliably (e.g. some overlay/network mounts used for mounted secrets).
+const restatInterval = time.Minute
+
+// DynamicConfig watches a certificate/key pair, and optionally a client CA
+// bundle, reloading them in place whenever they change on disk.
+type DynamicConfig struct {
+	logger log.Logger
+
+	certFile, keyFile string
+	clientCAFile      string
+
+	// certSource, when set, is another DynamicConfig already watching
+	// certFile/keyFile; this instance serves that DynamicConfig's certificate
+	// instead of watching the same files a second time, and only watches its
+	// own clientCAFile. See NewSharedCert.
+	certSource *DynamicConfig
+
+	cert      atomic.Value // *tls.Certificate
+	clientCAs atomic.Value // *x509.CertPool
+
+	// reloadMu serializes reload (run's ticker/fsnotify path and ForceReload,
+	// which may be called concurrently from a signal handler) and guards the
+	// mod-time fields below.
+	reloadMu        sync.Mutex
+	certModTime     time.Time
+	clientCAModTime time.Time
+
+	watcher *fsnotify.Watcher
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// New loads the given certificate pair (and client CA bundle, if clientCAFile
+// is non-empty) and starts watching them for changes. Callers must call
+// Close when the config is no longer needed.
+func New(logger log.Logger, certFile, keyFile, clientCAFile string) (*DynamicConfig, error) {
+	c := &DynamicConfig{
+		logger:       log.With(logger, "component", "tlsconfig"),
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+
+	if _, err := c.reloadCert(); err != nil {
+		return nil, err
+	}
+	if clientCAFile != "" {
+		if _, err := c.reloadClientCAs(); err != nil {
+			return nil, err
+		}
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create TLS file watcher: %v", err)
+	}
+	watched := make(map[string]struct{})
+	for _, f := range []string{certFile, keyFile, clientCAFile} {
+		if f == "" {
+			continue
+		}
+		dir := filepath.Dir(f)
+		if _, ok := watched[dir]; ok {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("unable to watch %s: %v", dir, err)
+		}
+		watched[dir] = struct{}{}
+	}
+	c.watcher = watcher
+
+	go c.run()
+
+	return c, nil
+}
+
+// NewSharedCert returns a DynamicConfig that requires and verifies client
+// certificates against clientCAFile, but serves its certificate from
+// certSource instead of loading and watching certSource's cert/key files a
+// second time. Use this for a second listener that needs a stricter
+// ClientAuth policy against a certificate a sibling listener already keeps
+// fresh. Callers must call Close when the config is no longer needed.
+func NewSharedCert(logger log.Logger, certSource *DynamicConfig, clientCAFile string) (*DynamicConfig, error) {
+	c := &DynamicConfig{
+		logger:       log.With(logger, "component", "tlsconfig"),
+		clientCAFile: clientCAFile,
+		certSource:   certSource,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+
+	if _, err := c.reloadClientCAs(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create TLS file watcher: %v", err)
+	}
+	if err := watcher.Add(filepath.Dir(clientCAFile)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("unable to watch %s: %v", filepath.Dir(clientCAFile), err)
+	}
+	c.watcher = watcher
+
+	go c.run()
+
+	return c, nil
+}
+
+// run reloads the certificate and CA bundle on fsnotify events, falling back
+// to a coarse periodic re-stat in case events are missed.
+func (c *DynamicConfig) run() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(restatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-c.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Chmod) != 0 {
+				c.reload()
+			}
+		case err, ok := <-c.watcher.Errors:
+			if !ok {
+				return
+			}
+			level.Error(c.logger).Log("msg", "TLS file watcher error", "err", err)
+		case <-ticker.C:
+			c.reload()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// reload re-stats the certificate and, if configured, the client CA bundle,
+// re-reading and logging only the ones whose mtime has actually advanced
+// since the last successful load, and keeping the previous material in place
+// on failure. Serialized by reloadMu since it runs from both run's
+// ticker/fsnotify path and ForceReload.
+func (c *DynamicConfig) reload() {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+
+	// certSource's own run goroutine already reloads the shared cert/key
+	// files; reloading them here too would just be a second, redundant watch.
+	if c.certSource == nil {
+		if changed, err := c.reloadCert(); err != nil {
+			level.Error(c.logger).Log("msg", "failed to reload TLS certificate, keeping previous", "err", err)
+		} else if changed {
+			level.Info(c.logger).Log("msg", "reloaded TLS certificate")
+		}
+	}
+
+	if c.clientCAFile == "" {
+		return
+	}
+	if changed, err := c.reloadClientCAs(); err != nil {
+		level.Error(c.logger).Log("msg", "failed to reload client CA bundle, keeping previous", "err", err)
+	} else if changed {
+		level.Info(c.logger).Log("msg", "reloaded client CA bundle")
+	}
+}
+
+// ForceReload reloads the certificate and CA bundle immediately, regardless
+// of whether a change was observed. Intended for wiring up a SIGHUP handler.
+func (c *DynamicConfig) ForceReload() {
+	// Forget the last loaded mtimes so reload re-reads every file even if
+	// none of them has advanced.
+	c.reloadMu.Lock()
+	c.certModTime = time.Time{}
+	c.clientCAModTime = time.Time{}
+	c.reloadMu.Unlock()
+
+	c.reload()
+}
+
+// reloadCert loads the certificate pair if the newer of the two files' mtimes
+// has advanced since the last successful load, reporting whether it did.
+func (c *DynamicConfig) reloadCert() (bool, error) {
+	mtime, err := latestModTime(c.certFile, c.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat TLS certificate pair: %v", err)
+	}
+	if c.cert.Load() != nil && !mtime.After(c.certModTime) {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to load TLS certificate pair: %v", err)
+	}
+	c.cert.Store(&cert)
+	c.certModTime = mtime
+	return true, nil
+}
+
+// reloadClientCAs loads the client CA bundle if its mtime has advanced since
+// the last successful load, reporting whether it did.
+func (c *DynamicConfig) reloadClientCAs() (bool, error) {
+	mtime, err := latestModTime(c.clientCAFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat client CA bundle: %v", err)
+	}
+	if c.clientCAs.Load() != nil && !mtime.After(c.clientCAModTime) {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadFile(c.clientCAFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to read client CA bundle: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return false, fmt.Errorf("no certificates found in %s", c.clientCAFile)
+	}
+	c.clientCAs.Store(pool)
+	c.clientCAModTime = mtime
+	return true, nil
+}
+
+// loadedCert returns the current certificate, deferring to certSource if
+// this DynamicConfig doesn't watch its own cert/key files.
+func (c *DynamicConfig) loadedCert() *tls.Certificate {
+	if c.certSource != nil {
+		return c.certSource.loadedCert()
+	}
+	return c.cert.Load().(*tls.Certificate)
+}
+
+// latestModTime returns the most recent modification time across paths.
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// TLSConfig returns a *tls.Config backed by this DynamicConfig's atomically
+// swappable cache. If a client CA bundle was configured, the returned config
+// requires and verifies client certificates against the current bundle.
+func (c *DynamicConfig) TLSConfig() *tls.Config {
+	cfg := &tls.Config{
+		// http.Server.ServeTLS sets this automatically; since we bypass it in
+		// favor of our own tls.Listener, it must be set explicitly here too or
+		// ALPN negotiation silently falls back to HTTP/1.1.
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return c.loadedCert(), nil
+		},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return c.loadedCert(), nil
+		},
+	}
+
+	if c.clientCAFile != "" {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			clone := cfg.Clone()
+			clone.GetConfigForClient = nil
+			clone.ClientCAs = c.clientCAs.Load().(*x509.CertPool)
+			return clone, nil
+		}
+	}
+
+	return cfg
+}
+
+// Close stops the watcher goroutine and releases its resources.
+func (c *DynamicConfig) Close() error {
+	close(c.stop)
+	err := c.watcher.Close()
+	<-c.done
+	return err
+}
@@ -0,0 +1,307 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// writeCert generates a self-signed certificate/key pair for commonName and
+// writes it (PEM-encoded) to certFile/keyFile, returning its DER bytes for
+// use as a client CA bundle.
+func writeCert(t *testing.T, certFile, keyFile, commonName string) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	certOut := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(certFile, certOut, 0600); err != nil {
+		t.Fatalf("failed to write cert file: %v", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	keyOut := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(keyFile, keyOut, 0600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+
+	return der
+}
+
+// bumpModTime sets path's mtime to the future, guaranteeing it advances past
+// a prior reload regardless of the filesystem's mtime resolution.
+func bumpModTime(t *testing.T, path string) {
+	t.Helper()
+
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatalf("failed to bump mtime of %s: %v", path, err)
+	}
+}
+
+func newTestConfig(t *testing.T, clientCA bool) (*DynamicConfig, string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	writeCert(t, certFile, keyFile, "server")
+
+	clientCAFile := ""
+	if clientCA {
+		clientCAFile = filepath.Join(dir, "client-ca.crt")
+		writeCert(t, clientCAFile, filepath.Join(dir, "client-ca.key"), "client-ca")
+	}
+
+	c := &DynamicConfig{
+		logger:       log.NewNopLogger(),
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+	}
+	if _, err := c.reloadCert(); err != nil {
+		t.Fatalf("reloadCert() failed: %v", err)
+	}
+	if clientCAFile != "" {
+		if _, err := c.reloadClientCAs(); err != nil {
+			t.Fatalf("reloadClientCAs() failed: %v", err)
+		}
+	}
+	return c, certFile, keyFile
+}
+
+func TestTLSConfigWithoutClientCAHasNoClientAuth(t *testing.T) {
+	c, _, _ := newTestConfig(t, false)
+
+	cfg := c.TLSConfig()
+	if cfg.ClientAuth != tls.NoClientCert {
+		t.Errorf("ClientAuth = %v, want NoClientCert when no client CA bundle is configured", cfg.ClientAuth)
+	}
+	if cfg.GetConfigForClient != nil {
+		t.Error("GetConfigForClient should be nil when no client CA bundle is configured")
+	}
+	if len(cfg.NextProtos) == 0 {
+		t.Error("expected NextProtos to be set so ALPN negotiation doesn't silently fall back")
+	}
+	if _, err := cfg.GetCertificate(nil); err != nil {
+		t.Errorf("GetCertificate returned error: %v", err)
+	}
+}
+
+func TestTLSConfigWithClientCARequiresClientCert(t *testing.T) {
+	c, _, _ := newTestConfig(t, true)
+
+	cfg := c.TLSConfig()
+	if cfg.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("ClientAuth = %v, want RequireAndVerifyClientCert when a client CA bundle is configured", cfg.ClientAuth)
+	}
+	if cfg.GetConfigForClient == nil {
+		t.Fatal("expected GetConfigForClient to be set when a client CA bundle is configured")
+	}
+
+	clientCfg, err := cfg.GetConfigForClient(nil)
+	if err != nil {
+		t.Fatalf("GetConfigForClient returned error: %v", err)
+	}
+	if clientCfg.ClientCAs == nil || len(clientCfg.ClientCAs.Subjects()) == 0 {
+		t.Error("expected the per-client config to carry the loaded client CA pool")
+	}
+}
+
+func TestReloadCertPicksUpRotatedMaterial(t *testing.T) {
+	c, certFile, keyFile := newTestConfig(t, false)
+
+	before := c.cert.Load().(*tls.Certificate)
+
+	// Rotate the certificate on disk to a new key pair, and force the mtime
+	// forward so the change is detected regardless of filesystem resolution.
+	writeCert(t, certFile, keyFile, "server-rotated")
+	bumpModTime(t, certFile)
+	bumpModTime(t, keyFile)
+
+	changed, err := c.reloadCert()
+	if err != nil {
+		t.Fatalf("reloadCert() failed: %v", err)
+	}
+	if !changed {
+		t.Error("expected reloadCert to report a change after the mtime advanced")
+	}
+
+	after := c.cert.Load().(*tls.Certificate)
+	if before == after {
+		t.Error("expected reloadCert to swap in a new certificate value")
+	}
+}
+
+func TestReloadCertSkipsUnchangedFile(t *testing.T) {
+	c, _, _ := newTestConfig(t, false)
+
+	changed, err := c.reloadCert()
+	if err != nil {
+		t.Fatalf("reloadCert() failed: %v", err)
+	}
+	if changed {
+		t.Error("expected reloadCert to report no change when the mtime hasn't advanced")
+	}
+}
+
+func TestReloadCertFailsOnMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	c := &DynamicConfig{
+		logger:   log.NewNopLogger(),
+		certFile: filepath.Join(dir, "missing.crt"),
+		keyFile:  filepath.Join(dir, "missing.key"),
+	}
+
+	if _, err := c.reloadCert(); err == nil {
+		t.Error("expected reloadCert to fail for a nonexistent certificate file")
+	}
+}
+
+func TestReloadClientCAsRejectsInvalidPEM(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "client-ca.crt")
+	if err := ioutil.WriteFile(caFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("failed to write bogus CA file: %v", err)
+	}
+
+	c := &DynamicConfig{logger: log.NewNopLogger(), clientCAFile: caFile}
+	if _, err := c.reloadClientCAs(); err == nil {
+		t.Error("expected reloadClientCAs to fail for a file with no valid certificates")
+	}
+}
+
+func TestNewRunReloadsOnFileChange(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	writeCert(t, certFile, keyFile, "server")
+
+	c, err := New(log.NewNopLogger(), certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+	defer c.Close()
+
+	before := c.cert.Load().(*tls.Certificate)
+
+	writeCert(t, certFile, keyFile, "server-rotated")
+	bumpModTime(t, certFile)
+	bumpModTime(t, keyFile)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if c.cert.Load().(*tls.Certificate) != before {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for the background watcher to reload the rotated certificate")
+}
+
+func TestCloseStopsTheWatcher(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	writeCert(t, certFile, keyFile, "server")
+
+	c, err := New(log.NewNopLogger(), certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- c.Close() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Close() returned error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close() did not return in time")
+	}
+}
+
+func TestNewSharedCertServesSourcesCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	writeCert(t, certFile, keyFile, "server")
+
+	source, err := New(log.NewNopLogger(), certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+	defer source.Close()
+
+	clientCAFile := filepath.Join(dir, "client-ca.crt")
+	writeCert(t, clientCAFile, filepath.Join(dir, "client-ca.key"), "client-ca")
+
+	shared, err := NewSharedCert(log.NewNopLogger(), source, clientCAFile)
+	if err != nil {
+		t.Fatalf("NewSharedCert() failed: %v", err)
+	}
+	defer shared.Close()
+
+	if shared.loadedCert() != source.loadedCert() {
+		t.Error("expected a shared DynamicConfig to serve the same certificate as its source")
+	}
+
+	cfg := shared.TLSConfig()
+	if cfg.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("ClientAuth = %v, want RequireAndVerifyClientCert", cfg.ClientAuth)
+	}
+	if _, err := cfg.GetCertificate(nil); err != nil {
+		t.Errorf("GetCertificate returned error: %v", err)
+	}
+
+	// Rotating the shared certificate at its source must be reflected here
+	// too, without this DynamicConfig watching certFile/keyFile itself.
+	before := shared.loadedCert()
+	writeCert(t, certFile, keyFile, "server-rotated")
+	bumpModTime(t, certFile)
+	bumpModTime(t, keyFile)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if shared.loadedCert() != before {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for the shared DynamicConfig to observe the source's rotated certificate")
+}